@@ -0,0 +1,252 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package cluster lets several erfserver instances share state without a
+// central etcd, by replicating every Append through a Raft log: Append on any
+// node proposes the record to the cluster, and every node's FSM applies it
+// to an identical, independent erfserver.ERFServer.
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/thales-e-security/erfserver"
+)
+
+// ErrNotLeader is the cause of the error Append returns when called on a node
+// that isn't the current Raft leader. Raft only accepts proposals on the
+// leader, and this package has no RPC layer of its own to forward a proposal
+// to one on the caller's behalf, so the caller must route Append to the
+// leader itself; Leader reports its current address for that purpose.
+var ErrNotLeader = errors.New("this node is not the raft leader")
+
+// ReadConsistency controls how strongly a read is synchronised with the Raft
+// leader before it is served from this node's local state.
+type ReadConsistency int
+
+const (
+	// ReadConsistencyLocal serves reads from local state immediately, which may
+	// lag the leader by however long replication takes.
+	ReadConsistencyLocal ReadConsistency = iota
+
+	// ReadConsistencyLinearizable forces a Raft barrier before serving a read,
+	// so that on the leader it reflects every Append that had already been
+	// accepted when the read began. A barrier only succeeds on the leader; if
+	// it fails (on a follower, or with no leader) the read is served from
+	// local state as with ReadConsistencyLocal.
+	ReadConsistencyLinearizable
+)
+
+// ClusterConfig configures a clustered ERFServer.
+type ClusterConfig struct {
+	// NodeID uniquely identifies this node within the cluster.
+	NodeID string
+
+	// BindAddr is the host:port this node's Raft transport listens on.
+	BindAddr string
+
+	// BootstrapPeers maps every node ID to its BindAddr, for every node that
+	// should form the initial cluster configuration (including this node).
+	// Leave nil when joining an already-bootstrapped cluster.
+	BootstrapPeers map[string]string
+
+	// SnapshotDir is where Raft snapshots of the record log are written.
+	SnapshotDir string
+
+	// Verifier authenticates every token passed to Append.
+	Verifier erfserver.TokenVerifier
+
+	// ReadConsistency controls how reads are served. The zero value is ReadConsistencyLocal.
+	ReadConsistency ReadConsistency
+}
+
+// command is the payload replicated through the Raft log for a single Append
+// call. It carries the already-verified facts about the token, not the raw
+// token itself: verification happens once, on the node that received the
+// original Append, before the record is proposed. fsm.Apply must produce the
+// same outcome on every node that replays a given log entry, and token
+// verification can't be trusted to agree everywhere it runs — an expiry
+// check is wall-clock dependent, and a JWKSVerifier's key cache may not have
+// refreshed identically on every node yet.
+type command struct {
+	Subject      string
+	Previous     string
+	Operation    string
+	UTCTime      int64
+	SigningKeyID string
+}
+
+// NewClustered creates an ERFServer that replicates every Append through a
+// Raft log, so that every node in the cluster converges on an identical
+// record history, DAG cache and canonical client IDs.
+func NewClustered(cfg ClusterConfig) (erfserver.ERFServer, error) {
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(cfg.NodeID)
+
+	addr, err := net.ResolveTCPAddr("tcp", cfg.BindAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve bind address")
+	}
+
+	transport, err := raft.NewTCPTransport(cfg.BindAddr, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create raft transport")
+	}
+
+	snapshotStore, err := raft.NewFileSnapshotStore(cfg.SnapshotDir, 2, os.Stderr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create raft snapshot store")
+	}
+
+	// The log and stable stores hold uncommitted Raft state, not the ERF
+	// record history itself (that lives in the FSM, snapshotted separately),
+	// so an in-memory store is enough for a node that can always catch up
+	// from a peer's snapshot after restarting.
+	logStore := raft.NewInmemStore()
+	stableStore := raft.NewInmemStore()
+
+	fsm := newFSM(cfg.Verifier)
+
+	r, err := raft.NewRaft(raftConfig, fsm, logStore, stableStore, snapshotStore, transport)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start raft")
+	}
+
+	if len(cfg.BootstrapPeers) > 0 {
+		hasState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to check for existing raft state")
+		}
+
+		// A node restarting with BootstrapPeers still set has a snapshot on
+		// disk even though logStore/stableStore are freshly in-memory;
+		// bootstrapping again would fail with raft.ErrCantBootstrap. Skip it
+		// and let this node catch up from its snapshot and peers instead.
+		if !hasState {
+			servers := make([]raft.Server, 0, len(cfg.BootstrapPeers))
+			for id, peerAddr := range cfg.BootstrapPeers {
+				servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(peerAddr)})
+			}
+
+			if err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+				return nil, errors.Wrap(err, "failed to bootstrap raft cluster")
+			}
+		}
+	}
+
+	return &Server{
+		nodeID:          cfg.NodeID,
+		raft:            r,
+		fsm:             fsm,
+		verifier:        cfg.Verifier,
+		readConsistency: cfg.ReadConsistency,
+	}, nil
+}
+
+// Server is an erfserver.ERFServer backed by a Raft-replicated record log.
+type Server struct {
+	nodeID   string
+	raft     *raft.Raft
+	fsm      *fsm
+	verifier erfserver.TokenVerifier
+
+	readConsistency ReadConsistency
+}
+
+// Append implements erfserver.ERFServer.Append. It verifies token once, on
+// this node, then proposes the verified record to the Raft cluster; it
+// returns once a quorum has durably accepted it. The record is only visible
+// to reads once fsm.Apply has run on this node.
+//
+// raft.Raft.Apply only succeeds on the current leader; called on a follower
+// it returns raft.ErrNotLeader, which Append surfaces as ErrNotLeader rather
+// than a generic failure, so a caller can retry against Leader() instead of
+// treating the append as having failed outright.
+func (s *Server) Append(token []byte, operation string, t time.Time) error {
+	claims, keyID, err := s.verifier.Verify(token)
+	if err != nil {
+		return errors.Wrapf(erfserver.ErrInvalidToken, "failed to verify token: %v", err)
+	}
+
+	cmd := command{
+		Subject:      *claims.Subject,
+		Previous:     *claims.Previous,
+		Operation:    operation,
+		UTCTime:      t.UTC().Unix(),
+		SigningKeyID: keyID,
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cmd); err != nil {
+		return errors.Wrap(err, "failed to encode command")
+	}
+
+	future := s.raft.Apply(buf.Bytes(), 10*time.Second)
+	if err := future.Error(); err != nil {
+		if err == raft.ErrNotLeader {
+			return errors.Wrapf(ErrNotLeader, "node %s is not the leader", s.nodeID)
+		}
+		return errors.Wrap(err, "failed to replicate append")
+	}
+
+	if err, ok := future.Response().(error); ok && err != nil {
+		return errors.Wrap(err, "append rejected")
+	}
+
+	return nil
+}
+
+// TotalClients implements erfserver.ERFServer.TotalClients
+func (s *Server) TotalClients() int {
+	s.maybeBarrier()
+	return s.fsm.totalClients()
+}
+
+// RecentClients implements erfserver.ERFServer.RecentClients
+func (s *Server) RecentClients(since time.Time) int {
+	s.maybeBarrier()
+	return s.fsm.recentClients(since)
+}
+
+// OperationsByClient implements erfserver.ERFServer.OperationsByClient
+func (s *Server) OperationsByClient() map[string]map[string]int {
+	s.maybeBarrier()
+	return s.fsm.operationsByClient()
+}
+
+// Leader returns the bind address of the node this node currently believes
+// is the Raft leader, or "" if it doesn't know of one. A caller that gets
+// ErrNotLeader from Append should retry against this address instead.
+func (s *Server) Leader() string {
+	return string(s.raft.Leader())
+}
+
+// maybeBarrier forces this node to catch up with the leader before a read,
+// if configured to do so.
+func (s *Server) maybeBarrier() {
+	if s.readConsistency != ReadConsistencyLinearizable {
+		return
+	}
+
+	// A barrier failure (e.g. no leader) just means the read falls back to
+	// whatever this node has applied so far, rather than failing outright.
+	_ = s.raft.Barrier(5 * time.Second).Error()
+}
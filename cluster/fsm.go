@@ -0,0 +1,164 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/thales-e-security/erfserver"
+	"github.com/thales-e-security/erfserver/storage"
+)
+
+// fsm is the raft.FSM that replicates Append calls to every node in the
+// cluster. Every node applies the same sequence of commands to its own
+// storage.RecordStore and erfserver.ERFServer, so all nodes converge on
+// identical records, adjacency lists and canonical client IDs.
+type fsm struct {
+	verifier erfserver.TokenVerifier
+
+	// mux protects store and inner, which are swapped wholesale by Restore.
+	// It does not need to be held across Apply, since raft guarantees Apply
+	// is never called concurrently with itself or with Restore.
+	mux   sync.RWMutex
+	store storage.RecordStore
+	inner erfserver.ERFServer
+}
+
+// newFSM creates an fsm backed by a fresh, empty in-memory RecordStore.
+func newFSM(verifier erfserver.TokenVerifier) *fsm {
+	store := storage.NewMemory()
+
+	return &fsm{
+		verifier: verifier,
+		store:    store,
+		inner:    erfserver.NewWithStore(store, verifier),
+	}
+}
+
+// Apply implements raft.FSM.Apply. It is only ever called by raft, with log
+// entries in the order they were committed, so it can append directly to
+// inner without any further coordination. cmd already carries a verified
+// record rather than a raw token, so Apply has no wall-clock or network
+// dependency and produces the same outcome on every node that replays it.
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	var cmd command
+	if err := gob.NewDecoder(bytes.NewReader(log.Data)).Decode(&cmd); err != nil {
+		return errors.Wrap(err, "failed to decode command")
+	}
+
+	f.mux.RLock()
+	inner := f.inner
+	f.mux.RUnlock()
+
+	appender, ok := inner.(erfserver.VerifiedAppender)
+	if !ok {
+		return errors.New("inner ERFServer does not support verified appends")
+	}
+
+	return appender.AppendVerified(erfserver.VerifiedRecord{
+		Subject:      cmd.Subject,
+		Previous:     cmd.Previous,
+		Operation:    cmd.Operation,
+		UTCTime:      cmd.UTCTime,
+		SigningKeyID: cmd.SigningKeyID,
+	})
+}
+
+// Snapshot implements raft.FSM.Snapshot by capturing the current record
+// history. Restoring from this snapshot replays the records straight into a
+// fresh RecordStore, so a new follower can catch up without reparsing and
+// reverifying every token in the log.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+
+	records, err := f.store.Snapshot()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to snapshot records")
+	}
+
+	return &fsmSnapshot{records: records}, nil
+}
+
+// Restore implements raft.FSM.Restore. The store and inner ERFServer are
+// rebuilt from the snapshotted records and then swapped in atomically, so
+// that totalClients, recentClients and operationsByClient never observe a
+// partially-restored state.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	var records []storage.Record
+	if err := gob.NewDecoder(rc).Decode(&records); err != nil {
+		return errors.Wrap(err, "failed to decode snapshot")
+	}
+
+	store := storage.NewMemory()
+	for _, r := range records {
+		if err := store.Append(r); err != nil {
+			return errors.Wrap(err, "failed to replay snapshotted record")
+		}
+	}
+
+	inner := erfserver.NewWithStore(store, f.verifier)
+
+	f.mux.Lock()
+	f.store = store
+	f.inner = inner
+	f.mux.Unlock()
+
+	return nil
+}
+
+func (f *fsm) totalClients() int {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	return f.inner.TotalClients()
+}
+
+func (f *fsm) recentClients(since time.Time) int {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	return f.inner.RecentClients(since)
+}
+
+func (f *fsm) operationsByClient() map[string]map[string]int {
+	f.mux.RLock()
+	defer f.mux.RUnlock()
+	return f.inner.OperationsByClient()
+}
+
+// fsmSnapshot adapts a slice of records to the raft.FSMSnapshot interface.
+type fsmSnapshot struct {
+	records []storage.Record
+}
+
+// Persist implements raft.FSMSnapshot.Persist.
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := gob.NewEncoder(sink).Encode(s.records); err != nil {
+		sink.Cancel()
+		return errors.Wrap(err, "failed to encode snapshot")
+	}
+
+	return sink.Close()
+}
+
+// Release implements raft.FSMSnapshot.Release. There is nothing to release:
+// records is an independent copy taken at Snapshot time.
+func (s *fsmSnapshot) Release() {}
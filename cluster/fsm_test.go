@@ -0,0 +1,130 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thales-e-security/erfserver"
+)
+
+func encodeCommand(t *testing.T, cmd command) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(cmd))
+	return buf.Bytes()
+}
+
+func applyCommand(f *fsm, data []byte) interface{} {
+	return f.Apply(&raft.Log{Data: data})
+}
+
+// requireApplySucceeds applies data to f and fails the test if Apply
+// returned a non-nil error. Apply returns interface{}, and a plain type
+// assertion to error would panic on its nil success result, so the assertion
+// is done the comma-ok way.
+func requireApplySucceeds(t *testing.T, f *fsm, data []byte) {
+	if err, ok := applyCommand(f, data).(error); ok {
+		require.NoError(t, err)
+	}
+}
+
+// TestApplyIsDeterministicAcrossNodes mirrors how NewClustered uses fsm: every
+// node applies the same already-verified commands, in the same order, to its
+// own fsm. Apply must not re-run verification, so two independent fsms (as if
+// they were two cluster nodes) must converge even for a command whose
+// UTCTime is already in the past, which a wall-clock expiry check would reject.
+func TestApplyIsDeterministicAcrossNodes(t *testing.T) {
+	nodeA := newFSM(erfserver.InsecureAllowNone{})
+	nodeB := newFSM(erfserver.InsecureAllowNone{})
+
+	commands := []command{
+		{Subject: "A", Previous: "", Operation: "op", UTCTime: time.Now().Add(-time.Hour).Unix(), SigningKeyID: "key-1"},
+		{Subject: "B", Previous: "A", Operation: "op", UTCTime: time.Now().Add(-time.Hour).Unix(), SigningKeyID: "key-1"},
+		{Subject: "C", Previous: "A", Operation: "op", UTCTime: time.Now().Add(-time.Hour).Unix(), SigningKeyID: "key-1"},
+	}
+
+	for _, cmd := range commands {
+		data := encodeCommand(t, cmd)
+
+		requireApplySucceeds(t, nodeA, data)
+		requireApplySucceeds(t, nodeB, data)
+	}
+
+	assert.Equal(t, nodeA.totalClients(), nodeB.totalClients())
+	assert.Equal(t, nodeA.operationsByClient(), nodeB.operationsByClient())
+}
+
+func TestApplyEnforcesChainOfCustody(t *testing.T) {
+	f := newFSM(erfserver.InsecureAllowNone{})
+
+	requireApplySucceeds(t, f, encodeCommand(t, command{
+		Subject: "A", Previous: "", Operation: "op", UTCTime: time.Now().Unix(), SigningKeyID: "key-1",
+	}))
+
+	err, ok := applyCommand(f, encodeCommand(t, command{
+		Subject: "B", Previous: "A", Operation: "op", UTCTime: time.Now().Unix(), SigningKeyID: "key-2",
+	})).(error)
+	require.True(t, ok)
+	assert.Error(t, err)
+}
+
+// fakeSnapshotSink is a minimal raft.SnapshotSink backed by an in-memory
+// buffer, enough to exercise fsmSnapshot.Persist without a real raft.FileSnapshotStore.
+type fakeSnapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *fakeSnapshotSink) ID() string    { return "test-snapshot" }
+func (s *fakeSnapshotSink) Cancel() error { return nil }
+func (s *fakeSnapshotSink) Close() error  { return nil }
+
+func TestSnapshotRestoreRoundTrip(t *testing.T) {
+	f := newFSM(erfserver.InsecureAllowNone{})
+
+	for _, cmd := range []command{
+		{Subject: "A", Previous: "", Operation: "op", UTCTime: time.Now().Unix(), SigningKeyID: "key-1"},
+		{Subject: "B", Previous: "A", Operation: "op", UTCTime: time.Now().Unix(), SigningKeyID: "key-1"},
+	} {
+		requireApplySucceeds(t, f, encodeCommand(t, cmd))
+	}
+
+	wantTotal := f.totalClients()
+	wantOps := f.operationsByClient()
+
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+
+	sink := &fakeSnapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	restored := newFSM(erfserver.InsecureAllowNone{})
+	require.NoError(t, restored.Restore(&nopReadCloser{Reader: bytes.NewReader(sink.Bytes())}))
+
+	assert.Equal(t, wantTotal, restored.totalClients())
+	assert.Equal(t, wantOps, restored.operationsByClient())
+}
+
+type nopReadCloser struct {
+	*bytes.Reader
+}
+
+func (nopReadCloser) Close() error { return nil }
@@ -0,0 +1,234 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package erfserver
+
+import "sort"
+
+// timeEntry associates a subject with the utcTime it was last appended, so
+// that dagCache can answer "which subjects have been active since X" with a
+// range query instead of a full scan.
+type timeEntry struct {
+	utcTime int64
+	subject string
+}
+
+// dagCache maintains the adjacency lists, canonical client IDs and per-client
+// operation counts for the DAG incrementally, so that TotalClients,
+// RecentClients and OperationsByClient don't have to re-derive them from the
+// full record history on every call. update must be called once per record,
+// in the order the records were appended.
+type dagCache struct {
+	lists adjacencyListPair
+
+	// canonicalID maps every ERF seen to its canonical client ID.
+	canonicalID map[string]string
+
+	// opCounts maps a canonical client ID to a count of operations, by operation name.
+	opCounts map[string]map[string]int
+
+	// sinks holds every ERF that is currently a leaf of the DAG (has no outgoing edges),
+	// i.e. every currently distinct client.
+	sinks map[string]bool
+
+	// signingKeyID maps every ERF seen to the ID of the key that signed the
+	// record it was introduced by, so Append can check a chain-of-custody
+	// violation before accepting a new link in the chain.
+	signingKeyID map[string]string
+
+	// timeIndex holds one entry per record, sorted ascending by utcTime, so that
+	// RecentClients can binary search to the first record at or after a given time.
+	timeIndex []timeEntry
+}
+
+// newDagCache creates an empty dagCache.
+func newDagCache() *dagCache {
+	return &dagCache{
+		lists: adjacencyListPair{
+			incoming: make(map[string]*stringSet),
+			outgoing: make(map[string]*stringSet),
+		},
+		canonicalID:  make(map[string]string),
+		opCounts:     make(map[string]map[string]int),
+		sinks:        make(map[string]bool),
+		signingKeyID: make(map[string]string),
+	}
+}
+
+// update folds a newly appended record into the cache.
+func (c *dagCache) update(r record) {
+	sub := r.Subject
+	pre := r.Previous
+
+	c.registerNode(sub)
+	c.insertTimeEntry(r.UTCTime, sub)
+	if _, seen := c.signingKeyID[sub]; !seen {
+		c.signingKeyID[sub] = r.SigningKeyID
+	}
+
+	if pre != "" {
+		c.registerNode(pre)
+
+		if !c.lists.incoming[sub].contains(pre) {
+			wasSink := c.lists.outgoing[pre].size() == 0
+
+			c.lists.incoming[sub].add(pre)
+			c.lists.outgoing[pre].add(sub)
+
+			var newID string
+			if wasSink {
+				// pre's first child inherits pre's canonical ID, matching mapCanonicalIDs.
+				delete(c.sinks, pre)
+				newID = c.canonicalID[pre]
+			} else {
+				// pre already had a child, so this is a new branch: sub starts a new canonical ID.
+				newID = sub
+			}
+
+			// Records don't always arrive in chain order (see insertTimeEntry):
+			// sub may already have been seen as a root of its own subtree
+			// before pre showed up to reparent it. If so, sub's canonical ID
+			// just changed, and everything beneath it that had inherited the
+			// old one (and the operations already counted against it) has to
+			// follow, or it'll disagree with a batch cacheFromRecords rebuild.
+			if oldID := c.canonicalID[sub]; oldID != newID {
+				c.reassignCanonicalID(sub, oldID, newID)
+			}
+		}
+	}
+
+	clientID := c.canonicalID[sub]
+	clientOperations, found := c.opCounts[clientID]
+	if !found {
+		clientOperations = make(map[string]int)
+		c.opCounts[clientID] = clientOperations
+	}
+	clientOperations[r.Operation]++
+}
+
+// registerNode ensures node has entries in the adjacency lists, is tracked as
+// a sink and defaults to being its own canonical ID, as a root would be. The
+// default canonical ID is overwritten by update if node turns out to have a
+// parent. It is a no-op if node has already been seen.
+func (c *dagCache) registerNode(node string) {
+	if _, exists := c.lists.outgoing[node]; exists {
+		return
+	}
+
+	c.lists.outgoing[node] = newStringSet()
+	c.lists.incoming[node] = newStringSet()
+	c.sinks[node] = true
+	c.canonicalID[node] = node
+}
+
+// reassignCanonicalID renames node's canonical ID from oldID to newID, then
+// cascades into node's existing children that had inherited oldID, so a
+// reparented subtree converges on newID all the way down rather than just at
+// its new root. Operations already counted under oldID move with it.
+func (c *dagCache) reassignCanonicalID(node, oldID, newID string) {
+	c.canonicalID[node] = newID
+	c.migrateOpCounts(oldID, newID)
+
+	for _, child := range c.lists.outgoing[node].values() {
+		if c.canonicalID[child] == oldID {
+			c.reassignCanonicalID(child, oldID, newID)
+		}
+	}
+}
+
+// migrateOpCounts moves oldID's operation counts onto newID, merging them
+// into any counts newID already has, for use when reassignCanonicalID
+// renames a canonical ID that already has recorded operations.
+func (c *dagCache) migrateOpCounts(oldID, newID string) {
+	old, ok := c.opCounts[oldID]
+	if !ok {
+		return
+	}
+	delete(c.opCounts, oldID)
+
+	target, exists := c.opCounts[newID]
+	if !exists {
+		c.opCounts[newID] = old
+		return
+	}
+	for op, count := range old {
+		target[op] += count
+	}
+}
+
+// insertTimeEntry inserts (utcTime, subject) into timeIndex, keeping it sorted
+// ascending by utcTime. Records don't always arrive in time order (clients can
+// submit operations for older tokens), so this is an insertion, not an append.
+func (c *dagCache) insertTimeEntry(utcTime int64, subject string) {
+	i := sort.Search(len(c.timeIndex), func(i int) bool {
+		return c.timeIndex[i].utcTime > utcTime
+	})
+
+	c.timeIndex = append(c.timeIndex, timeEntry{})
+	copy(c.timeIndex[i+1:], c.timeIndex[i:])
+	c.timeIndex[i] = timeEntry{utcTime: utcTime, subject: subject}
+}
+
+// totalClients returns the number of currently distinct clients (DAG sinks).
+func (c *dagCache) totalClients() int {
+	return len(c.sinks)
+}
+
+// recentClients returns the number of distinct clients whose most recent
+// record was appended at or after sinceUTC, without scanning records older
+// than sinceUTC.
+func (c *dagCache) recentClients(sinceUTC int64) int {
+	i := sort.Search(len(c.timeIndex), func(i int) bool {
+		return c.timeIndex[i].utcTime >= sinceUTC
+	})
+
+	seen := make(map[string]bool)
+	count := 0
+
+	for _, entry := range c.timeIndex[i:] {
+		if seen[entry.subject] {
+			continue
+		}
+		seen[entry.subject] = true
+
+		if c.sinks[entry.subject] {
+			count++
+		}
+	}
+
+	return count
+}
+
+// signerOf returns the ID of the key that signed the record that introduced
+// subject, if subject has been seen before.
+func (c *dagCache) signerOf(subject string) (string, bool) {
+	id, ok := c.signingKeyID[subject]
+	return id, ok
+}
+
+// operationsByClient returns a copy of opCounts, keyed by canonical client ID.
+func (c *dagCache) operationsByClient() map[string]map[string]int {
+	result := make(map[string]map[string]int, len(c.opCounts))
+
+	for clientID, operations := range c.opCounts {
+		ops := make(map[string]int, len(operations))
+		for op, count := range operations {
+			ops[op] = count
+		}
+		result[clientID] = ops
+	}
+
+	return result
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package erfserver
+
+import (
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	erf "github.com/thales-e-security/erfcommon"
+)
+
+// InsecureAllowNone is a TokenVerifier that accepts unsigned (alg "none")
+// tokens without checking a signature at all. It provides no authentication
+// whatsoever and must only be used in tests.
+type InsecureAllowNone struct{}
+
+// Verify implements TokenVerifier.Verify
+func (InsecureAllowNone) Verify(token []byte) (*erf.ErfClaims, string, error) {
+	var claims erf.ErfClaims
+
+	_, err := jwt.ParseWithClaims(string(token), &claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodNone {
+			return nil, errors.Errorf("InsecureAllowNone only accepts unsigned tokens, got %q", t.Header["alg"])
+		}
+		return jwt.UnsafeAllowNoneSignatureType, nil
+	})
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to parse token")
+	}
+
+	if claims.ExpiresAt != nil && time.Now().Unix() > *claims.ExpiresAt {
+		return nil, "", errors.New("token has expired")
+	}
+
+	return &claims, "none", nil
+}
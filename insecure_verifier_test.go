@@ -0,0 +1,65 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package erfserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	erf "github.com/thales-e-security/erfcommon"
+)
+
+func TestInsecureAllowNoneAcceptsUnsignedToken(t *testing.T) {
+	claims, kid, err := InsecureAllowNone{}.Verify(makeJWT(t, "", "A"))
+	require.NoError(t, err)
+	assert.Equal(t, "none", kid)
+	assert.Equal(t, "A", *claims.Subject)
+}
+
+func TestInsecureAllowNoneRejectsSignedToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	_, _, err = InsecureAllowNone{}.Verify(makeRSAJWT(t, key, "key-1", "", "A"))
+	assert.Error(t, err)
+}
+
+func TestInsecureAllowNoneRejectsExpiredToken(t *testing.T) {
+	_, _, err := InsecureAllowNone{}.Verify(makeUnsignedJWTWithExpiry(t, "", "A", time.Now().Add(-time.Minute)))
+	assert.Error(t, err)
+}
+
+// makeUnsignedJWTWithExpiry is like makeJWT but with an explicit expiry, so
+// expired-token rejection can be exercised directly.
+func makeUnsignedJWTWithExpiry(t *testing.T, prev, subj string, expiresAt time.Time) []byte {
+	claims := erf.ErfClaims{
+		Subject:    erf.StringPtr(subj),
+		Previous:   erf.StringPtr(prev),
+		SequenceNo: erf.Int64Ptr(0),
+		IssuedAt:   erf.Int64Ptr(time.Now().Unix()),
+		ExpiresAt:  erf.Int64Ptr(expiresAt.Unix()),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, &claims)
+	s, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	return []byte(s)
+}
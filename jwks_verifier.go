@@ -0,0 +1,179 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package erfserver
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	erf "github.com/thales-e-security/erfcommon"
+)
+
+// NewJWKSVerifier creates a TokenVerifier that fetches its signing keys from a
+// JWKS URL and caches them, refreshing every refreshInterval (or never, if
+// refreshInterval is zero). The initial fetch happens synchronously; if it
+// fails, NewJWKSVerifier returns a nil verifier and a non-nil error.
+func NewJWKSVerifier(url string, refreshInterval time.Duration) (*JWKSVerifier, error) {
+	v := &JWKSVerifier{
+		url:        url,
+		httpClient: http.DefaultClient,
+		done:       make(chan struct{}),
+	}
+
+	if err := v.refresh(); err != nil {
+		return nil, errors.Wrap(err, "failed initial JWKS fetch")
+	}
+
+	if refreshInterval > 0 {
+		go v.refreshLoop(refreshInterval)
+	}
+
+	return v, nil
+}
+
+// JWKSVerifier is a TokenVerifier backed by a JWKS (RFC 7517) document fetched
+// over HTTP.
+type JWKSVerifier struct {
+	url        string
+	httpClient *http.Client
+	done       chan struct{}
+
+	mux  sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+// Close stops the background refresh started by NewJWKSVerifier.
+func (v *JWKSVerifier) Close() {
+	close(v.done)
+}
+
+// Verify implements TokenVerifier.Verify
+func (v *JWKSVerifier) Verify(token []byte) (*erf.ErfClaims, string, error) {
+	var kid string
+
+	claims, err := parseWithKeyFunc(token, func(t *jwt.Token) (interface{}, error) {
+		if err := requireAsymmetricSigning(t); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if kid, err = kidFromToken(t); err != nil {
+			return nil, err
+		}
+
+		v.mux.RLock()
+		key, ok := v.keys[kid]
+		v.mux.RUnlock()
+
+		if !ok {
+			return nil, errors.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to verify token")
+	}
+
+	return claims, kid, nil
+}
+
+func (v *JWKSVerifier) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// A failed refresh just leaves the verifier serving the last
+			// known-good key set, rather than taking it out of service.
+			_ = v.refresh()
+		case <-v.done:
+			return
+		}
+	}
+}
+
+func (v *JWKSVerifier) refresh() error {
+	resp, err := v.httpClient.Get(v.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var doc jwksDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return errors.Wrap(err, "failed to decode JWKS document")
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(doc.Keys))
+	for _, key := range doc.Keys {
+		pub, err := key.publicKey()
+		if err != nil {
+			// Skip keys we don't understand (e.g. a key type we don't
+			// support) rather than failing the whole refresh.
+			continue
+		}
+		keys[key.Kid] = pub
+	}
+
+	v.mux.Lock()
+	v.keys = keys
+	v.mux.Unlock()
+
+	return nil
+}
+
+// jwksDocument is the subset of RFC 7517 we need to extract RSA public keys.
+type jwksDocument struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// publicKey decodes an RSA public key from its JWK representation.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, errors.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode modulus")
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode exponent")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
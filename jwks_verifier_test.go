@@ -0,0 +1,170 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package erfserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	erf "github.com/thales-e-security/erfcommon"
+)
+
+// jwksTestServer serves a JWKS document that the test can swap out at will,
+// so refresh behaviour can be exercised without waiting on a real endpoint.
+type jwksTestServer struct {
+	*httptest.Server
+
+	mux  sync.Mutex
+	body []byte
+}
+
+func newJWKSTestServer(t *testing.T, keys ...jsonWebKey) *jwksTestServer {
+	s := &jwksTestServer{}
+	s.setKeys(t, keys...)
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		w.Write(s.body)
+	}))
+
+	return s
+}
+
+func (s *jwksTestServer) setKeys(t *testing.T, keys ...jsonWebKey) {
+	body, err := json.Marshal(jwksDocument{Keys: keys})
+	require.NoError(t, err)
+
+	s.mux.Lock()
+	s.body = body
+	s.mux.Unlock()
+}
+
+func jwkFromKey(kid string, key *rsa.PrivateKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big64(key.PublicKey.E)),
+	}
+}
+
+// big64 encodes a small int (an RSA exponent) as minimal big-endian bytes.
+func big64(i int) []byte {
+	b := []byte{byte(i >> 16), byte(i >> 8), byte(i)}
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func TestJWKSVerifierAcceptsTokenSignedByKnownKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	server := newJWKSTestServer(t, jwkFromKey("key-1", key))
+	defer server.Close()
+
+	v, err := NewJWKSVerifier(server.URL, 0)
+	require.NoError(t, err)
+	defer v.Close()
+
+	claims, kid, err := v.Verify(makeRSAJWT(t, key, "key-1", "", "A"))
+	require.NoError(t, err)
+	assert.Equal(t, "key-1", kid)
+	assert.Equal(t, "A", *claims.Subject)
+}
+
+func TestJWKSVerifierRejectsUnknownKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	server := newJWKSTestServer(t, jwkFromKey("key-1", key))
+	defer server.Close()
+
+	v, err := NewJWKSVerifier(server.URL, 0)
+	require.NoError(t, err)
+	defer v.Close()
+
+	_, _, err = v.Verify(makeRSAJWT(t, key, "key-2", "", "A"))
+	assert.Error(t, err)
+}
+
+func TestJWKSVerifierRejectsExpiredToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	server := newJWKSTestServer(t, jwkFromKey("key-1", key))
+	defer server.Close()
+
+	v, err := NewJWKSVerifier(server.URL, 0)
+	require.NoError(t, err)
+	defer v.Close()
+
+	expired := makeRSAJWTWithExpiry(t, key, "key-1", "", "A", time.Now().Add(-time.Minute))
+	_, _, err = v.Verify(expired)
+	assert.Error(t, err)
+}
+
+func TestJWKSVerifierPicksUpRotatedKeyOnRefresh(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	server := newJWKSTestServer(t, jwkFromKey("key-1", oldKey))
+	defer server.Close()
+
+	v, err := NewJWKSVerifier(server.URL, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer v.Close()
+
+	server.setKeys(t, jwkFromKey("key-2", newKey))
+
+	require.Eventually(t, func() bool {
+		_, _, err := v.Verify(makeRSAJWT(t, newKey, "key-2", "", "A"))
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "verifier never picked up the rotated key")
+}
+
+// makeRSAJWTWithExpiry is like makeRSAJWT but with an explicit expiry, so
+// expired-token rejection can be exercised directly.
+func makeRSAJWTWithExpiry(t *testing.T, key *rsa.PrivateKey, kid, prev, subj string, expiresAt time.Time) []byte {
+	claims := erf.ErfClaims{
+		Subject:    erf.StringPtr(subj),
+		Previous:   erf.StringPtr(prev),
+		SequenceNo: erf.Int64Ptr(0),
+		IssuedAt:   erf.Int64Ptr(time.Now().Unix()),
+		ExpiresAt:  erf.Int64Ptr(expiresAt.Unix()),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &claims)
+	token.Header["kid"] = kid
+
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return []byte(s)
+}
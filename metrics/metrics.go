@@ -0,0 +1,158 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package metrics wraps an erfserver.ERFServer with Prometheus instrumentation,
+// so that operators get the same observability posture other persistent-state
+// services provide out of the box.
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/thales-e-security/erfserver"
+)
+
+// recentWindows are the windows reported by the erf_recent_clients gauge.
+var recentWindows = map[string]time.Duration{
+	"5m":  5 * time.Minute,
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+}
+
+// defaultRefreshInterval is how often the gauges are refreshed from the
+// underlying ERFServer, if New is not given a different interval.
+const defaultRefreshInterval = 15 * time.Second
+
+// Server wraps an erfserver.ERFServer, exporting Prometheus metrics for every
+// Append and periodically refreshed gauges for TotalClients and
+// RecentClients.
+type Server struct {
+	erfserver.ERFServer
+
+	registry *prometheus.Registry
+
+	appendsTotal     *prometheus.CounterVec
+	appendDuration   prometheus.Histogram
+	tokenParseErrors prometheus.Counter
+	totalClients     prometheus.Gauge
+	recentClients    *prometheus.GaugeVec
+}
+
+// New wraps inner with Prometheus instrumentation, and starts a background
+// goroutine that refreshes the gauges every refreshInterval (or every
+// defaultRefreshInterval, if refreshInterval is zero).
+func New(inner erfserver.ERFServer, refreshInterval time.Duration) *Server {
+	if refreshInterval == 0 {
+		refreshInterval = defaultRefreshInterval
+	}
+
+	s := &Server{
+		ERFServer: inner,
+		registry:  prometheus.NewRegistry(),
+
+		appendsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "erf_appends_total",
+			Help: "Total number of Append calls, by operation and result.",
+		}, []string{"operation", "result"}),
+
+		appendDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "erf_append_duration_seconds",
+			Help: "Time taken to service an Append call.",
+		}),
+
+		tokenParseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "erf_token_parse_errors_total",
+			Help: "Total number of Append calls rejected because the ERF token failed to parse or verify.",
+		}),
+
+		totalClients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "erf_total_clients",
+			Help: "Number of distinct clients seen, as of the last refresh.",
+		}),
+
+		recentClients: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "erf_recent_clients",
+			Help: "Number of distinct clients with recent activity, as of the last refresh.",
+		}, []string{"window"}),
+	}
+
+	s.registry.MustRegister(s.appendsTotal, s.appendDuration, s.tokenParseErrors, s.totalClients, s.recentClients)
+
+	s.refresh()
+	go s.refreshLoop(refreshInterval)
+
+	return s
+}
+
+// Append implements erfserver.ERFServer.Append, instrumenting the call before
+// delegating to the wrapped ERFServer.
+func (s *Server) Append(token []byte, operation string, t time.Time) error {
+	start := time.Now()
+	err := s.ERFServer.Append(token, operation, t)
+	s.appendDuration.Observe(time.Since(start).Seconds())
+
+	result := "success"
+	if err != nil {
+		result = "error"
+		if errors.Cause(err) == erfserver.ErrInvalidToken {
+			s.tokenParseErrors.Inc()
+		}
+	}
+	s.appendsTotal.WithLabelValues(operation, result).Inc()
+
+	return err
+}
+
+// Handler returns an http.Handler serving Prometheus metrics at /metrics and
+// a JSON dump of OperationsByClient at /stats.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/stats", s.serveStats)
+	return mux
+}
+
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(s.OperationsByClient()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// refreshLoop refreshes the gauges every interval, until the process exits.
+func (s *Server) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.refresh()
+	}
+}
+
+// refresh re-populates the gauges from the wrapped ERFServer.
+func (s *Server) refresh() {
+	s.totalClients.Set(float64(s.TotalClients()))
+
+	now := time.Now()
+	for window, age := range recentWindows {
+		s.recentClients.WithLabelValues(window).Set(float64(s.RecentClients(now.Add(-age))))
+	}
+}
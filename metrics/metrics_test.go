@@ -0,0 +1,84 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	erf "github.com/thales-e-security/erfcommon"
+	"github.com/thales-e-security/erfserver"
+)
+
+func makeJWT(t *testing.T, prev, subj string) []byte {
+	claims := erf.ErfClaims{
+		Subject:    erf.StringPtr(subj),
+		Previous:   erf.StringPtr(prev),
+		SequenceNo: erf.Int64Ptr(0),
+		IssuedAt:   erf.Int64Ptr(time.Now().Unix()),
+		ExpiresAt:  erf.Int64Ptr(time.Now().Add(20 * time.Second).Unix()),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, &claims)
+	s, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	return []byte(s)
+}
+
+func TestAppendRecordsSuccessAndFailureCounters(t *testing.T) {
+	s := New(erfserver.NewInMemory(erfserver.InsecureAllowNone{}), time.Hour)
+
+	require.NoError(t, s.Append(makeJWT(t, "", "A"), "op", time.Now()))
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.appendsTotal.WithLabelValues("op", "success")))
+
+	err := s.Append([]byte("not a token"), "op", time.Now())
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.appendsTotal.WithLabelValues("op", "error")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.tokenParseErrors))
+}
+
+func TestRefreshPopulatesTotalClientsGauge(t *testing.T) {
+	s := New(erfserver.NewInMemory(erfserver.InsecureAllowNone{}), time.Hour)
+
+	require.NoError(t, s.Append(makeJWT(t, "", "A"), "op", time.Now()))
+	s.refresh()
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.totalClients))
+}
+
+func TestHandlerServesStatsAndMetrics(t *testing.T) {
+	s := New(erfserver.NewInMemory(erfserver.InsecureAllowNone{}), time.Hour)
+	require.NoError(t, s.Append(makeJWT(t, "", "A"), "op", time.Now()))
+
+	handler := s.Handler()
+
+	statsReq := httptest.NewRequest("GET", "/stats", nil)
+	statsRec := httptest.NewRecorder()
+	handler.ServeHTTP(statsRec, statsReq)
+	assert.Equal(t, 200, statsRec.Code)
+	assert.Contains(t, statsRec.Body.String(), `"A"`)
+
+	metricsReq := httptest.NewRequest("GET", "/metrics", nil)
+	metricsRec := httptest.NewRecorder()
+	handler.ServeHTTP(metricsRec, metricsReq)
+	assert.Equal(t, 200, metricsRec.Code)
+	assert.Contains(t, metricsRec.Body.String(), "erf_appends_total")
+}
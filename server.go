@@ -20,7 +20,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
-	erf "github.com/thales-e-security/erfcommon"
+	"github.com/thales-e-security/erfserver/storage"
 )
 
 // ERFServer registers client operations and indicates the number of unique
@@ -39,62 +39,141 @@ type ERFServer interface {
 	OperationsByClient() map[string]map[string]int
 }
 
+// VerifiedRecord carries the already-authenticated facts behind an Append
+// call, so they can be applied through VerifiedAppender without re-running
+// Verify. This matters to callers, such as cluster.fsm, that replicate an
+// Append through a medium (e.g. Raft) requiring every node to reach the same
+// outcome for the same input: re-verifying inside such a callback would make
+// the outcome depend on wall-clock expiry checks or a not-yet-converged JWKS
+// key cache, which can disagree from node to node even for one committed
+// entry.
+type VerifiedRecord struct {
+	// Subject is the ERF at the time of the operation.
+	Subject string
+
+	// Previous is the previous ERF (or "" if the ERF hasn't rolled over yet).
+	Previous string
+
+	// Operation is a string description of the operation the client performed.
+	Operation string
+
+	// UTCTime is the time the operation was received by the server, as UTC Unix seconds.
+	UTCTime int64
+
+	// SigningKeyID identifies the key that signed the token this record was derived from.
+	SigningKeyID string
+}
+
+// VerifiedAppender is implemented by every ERFServer returned by this
+// package. It lets a caller that has already authenticated a token apply the
+// resulting record directly, bypassing Verify.
+type VerifiedAppender interface {
+	// AppendVerified persists r, enforcing the same chain-of-custody check as
+	// Append, but without verifying a token.
+	AppendVerified(r VerifiedRecord) error
+}
+
 // adjacencyListPair holds the incoming and outgoing adjacency lists for the graph.
 type adjacencyListPair struct {
 	incoming map[string]*stringSet
 	outgoing map[string]*stringSet
 }
 
-// record captures the data for a single operation.
-type record struct {
-	// subject is the ERF at the time of the operation.
-	subject string
-
-	// previous is the previous ERF (or "" if the ERF hasn't rolled over yet).
-	previous string
+// record captures the data for a single operation. It is an alias of
+// storage.Record, kept so the rest of this file can refer to it without a
+// package qualifier.
+type record = storage.Record
+
+// ErrInvalidToken is the cause of the error Append returns when the supplied
+// token fails to parse. Callers can recover it with errors.Cause to
+// distinguish a bad token from a failure of the underlying RecordStore.
+var ErrInvalidToken = errors.New("invalid ERF token")
+
+// NewInMemory creates an ERFServer backed by a storage.RecordStore that keeps
+// its records in a plain in-memory slice. All state is lost on restart; use
+// NewWithStore with a durable RecordStore (such as storage/etcd) to persist
+// records across restarts or to share them between instances behind a load
+// balancer. Tokens are authenticated with v; production callers should pass
+// NewStaticKeyVerifier or NewJWKSVerifier rather than InsecureAllowNone.
+func NewInMemory(v TokenVerifier) ERFServer {
+	return NewWithStore(storage.NewMemory(), v)
+}
 
-	// operation is a string description of the operation the client performed.
-	operation string
+// NewWithStore creates an ERFServer backed by the given storage.RecordStore,
+// authenticating tokens with v. Any records already present in store are
+// loaded into the cache before NewWithStore returns. If store implements
+// storage.Shared (as storage/etcd does), the cache is also periodically
+// rebuilt from store, so that records appended by other processes sharing
+// that store are picked up even though they never pass through this
+// instance's own Append.
+func NewWithStore(store storage.RecordStore, v TokenVerifier) ERFServer {
+	s := &server{store: store, cache: newDagCache(), verifier: v}
+	_ = s.Rebuild()
+
+	if shared, ok := store.(storage.Shared); ok {
+		go s.periodicRebuild(shared.RefreshInterval())
+	}
 
-	// utcTime is the time the operation was received by the server.
-	utcTime int64
+	return s
 }
 
-// NewInMemory creates an ERFServer that stores records in a simple in-memory array.
-func NewInMemory() ERFServer {
-	return &inMemoryERFServer{}
+// periodicRebuild calls Rebuild every interval, for the lifetime of the
+// server, so that a Shared store's watch-fed Snapshot keeps this server's
+// cache converged with records appended by other processes. It does nothing
+// if interval is <= 0.
+func (s *server) periodicRebuild(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_ = s.Rebuild()
+	}
 }
 
-type inMemoryERFServer struct {
-	// store as simple array, to reflect future blockchain implementation
-	records []record
+type server struct {
+	// store persists the records appended to this server.
+	store storage.RecordStore
+
+	// verifier authenticates every token passed to Append.
+	verifier TokenVerifier
 
-	// mux protects the array of records
+	// cache incrementally tracks the DAG derived from store, so that reads
+	// don't have to re-derive it from the full record history every time.
+	cache *dagCache
+
+	// mux protects cache, and serialises access to store so that readers
+	// always see the effects of every Append that returned before they started.
 	mux sync.Mutex
 }
 
-// OperationsByClient implements ERFServer.OperationsByClient
-func (s *inMemoryERFServer) OperationsByClient() map[string]map[string]int {
+// Rebuild discards the incrementally maintained cache and rebuilds it from
+// scratch using the original batch algorithm (a full scan of store followed
+// by mapCanonicalIDs), rather than replaying records through the incremental
+// path. NewWithStore and periodicRebuild use it to load the cache from store,
+// and it doubles as a correctness check: the batch and incremental paths
+// must always agree on TotalClients, RecentClients and OperationsByClient.
+func (s *server) Rebuild() error {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	lists := s.adjacencyLists(nil)
-	result := make(map[string]map[string]int)
-
-	canonicalIDs := mapCanonicalIDs(lists)
-
-	for _, record := range s.records {
-		clientID := canonicalIDs[record.subject]
-		clientOperations, found := result[clientID]
-		if !found {
-			clientOperations = make(map[string]int)
-			result[clientID] = clientOperations
-		}
-
-		clientOperations[record.operation]++
+	records, err := s.store.Snapshot()
+	if err != nil {
+		return errors.Wrap(err, "failed to snapshot records")
 	}
 
-	return result
+	s.cache = cacheFromRecords(records)
+	return nil
+}
+
+// OperationsByClient implements ERFServer.OperationsByClient
+func (s *server) OperationsByClient() map[string]map[string]int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.cache.operationsByClient()
 }
 
 // mapCanonicalIDs parses the DAG and maps every ERF to a canonical client ID. Each
@@ -135,55 +214,30 @@ func mapCanonicalIDs(lists adjacencyListPair) map[string]string {
 }
 
 // RecentClients implements ERFServer.RecentClients
-func (s *inMemoryERFServer) RecentClients(since time.Time) int {
+func (s *server) RecentClients(since time.Time) int {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	return countSinks(s.adjacencyLists(&since).outgoing)
+	return s.cache.recentClients(since.UTC().Unix())
 }
 
 // TotalClients implements ERFServer.TotalClients
-func (s *inMemoryERFServer) TotalClients() int {
+func (s *server) TotalClients() int {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	return countSinks(s.adjacencyLists(nil).outgoing)
+	return s.cache.totalClients()
 }
 
-// countSinks finds leaf nodes, or 'sinks' in the DAG. Each sink represents a
-// distinct client.
-func countSinks(outgoingAdjacencyList map[string]*stringSet) int {
-	sinks := 0
-
-	// Find sinks in graph
-	for _, value := range outgoingAdjacencyList {
-		if value == nil {
-			sinks++
-		}
-	}
-	return sinks
-}
-
-// adjacencyLists builds a pair of adjacency lists (one incoming, one outgoing). The ordering of the
-// edges is consistent over time, due to the use of stringSet internally. It assumes s.mux is held by the
-// caller.
-func (s *inMemoryERFServer) adjacencyLists(since *time.Time) adjacencyListPair {
+// adjacencyLists builds a pair of adjacency lists (one incoming, one outgoing) from records. The
+// ordering of the edges is consistent over time, due to the use of stringSet internally.
+func adjacencyLists(records []record) adjacencyListPair {
 	res := adjacencyListPair{
 		incoming: make(map[string]*stringSet),
 		outgoing: make(map[string]*stringSet),
 	}
 
-	var sinceUTC int64
-
-	if since != nil {
-		sinceUTC = since.UTC().Unix()
-	}
-
-	for _, record := range s.records {
-		if since != nil && record.utcTime < sinceUTC {
-			continue
-		}
-
-		sub := record.subject
-		pre := record.previous
+	for _, record := range records {
+		sub := record.Subject
+		pre := record.Previous
 
 		// Always record the existence of a subject, in case it's a orphaned leaf.
 		// The code below preserves the existing value at that key.
@@ -211,22 +265,93 @@ func (s *inMemoryERFServer) adjacencyLists(since *time.Time) adjacencyListPair {
 	return res
 }
 
+// cacheFromRecords rebuilds a dagCache from scratch using the original batch
+// algorithm: a full adjacencyLists/mapCanonicalIDs pass over records, rather
+// than the incremental path used by dagCache.update.
+func cacheFromRecords(records []record) *dagCache {
+	lists := adjacencyLists(records)
+	canonicalIDs := mapCanonicalIDs(lists)
+
+	cache := newDagCache()
+	cache.lists = lists
+	cache.canonicalID = canonicalIDs
+
+	for node, outgoingEdges := range lists.outgoing {
+		if outgoingEdges == nil || outgoingEdges.size() == 0 {
+			cache.sinks[node] = true
+		}
+	}
+
+	// adjacencyLists leaves nil sets for nodes without edges (mapCanonicalIDs
+	// relies on that to find roots), but dagCache.update expects a non-nil set
+	// for every node it has seen, so fill them in before the cache is used.
+	for node := range lists.outgoing {
+		if lists.outgoing[node] == nil {
+			lists.outgoing[node] = newStringSet()
+		}
+		if lists.incoming[node] == nil {
+			lists.incoming[node] = newStringSet()
+		}
+	}
+
+	for _, record := range records {
+		cache.insertTimeEntry(record.UTCTime, record.Subject)
+		if _, seen := cache.signingKeyID[record.Subject]; !seen {
+			cache.signingKeyID[record.Subject] = record.SigningKeyID
+		}
+
+		clientID := canonicalIDs[record.Subject]
+		clientOperations, found := cache.opCounts[clientID]
+		if !found {
+			clientOperations = make(map[string]int)
+			cache.opCounts[clientID] = clientOperations
+		}
+		clientOperations[record.Operation]++
+	}
+
+	return cache
+}
+
 // Append implements ERFServer.Append
-func (s *inMemoryERFServer) Append(token []byte, operation string, time time.Time) error {
+func (s *server) Append(token []byte, operation string, t time.Time) error {
+	// Check token is valid, and find out who signed it, before we store it
+	claims, keyID, err := s.verifier.Verify(token)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidToken, "failed to verify token: %v", err)
+	}
+
+	return s.AppendVerified(VerifiedRecord{
+		Subject:      *claims.Subject,
+		Previous:     *claims.Previous,
+		Operation:    operation,
+		UTCTime:      t.UTC().Unix(),
+		SigningKeyID: keyID,
+	})
+}
+
+// AppendVerified implements VerifiedAppender.AppendVerified
+func (s *server) AppendVerified(r VerifiedRecord) error {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	// Check token is valid before we store it
-	_, claims, err := erf.ParseToken(token)
-	if err != nil {
-		return errors.Wrap(err, "failed to read token")
+	if r.Previous != "" {
+		if previousKeyID, seen := s.cache.signerOf(r.Previous); seen && previousKeyID != r.SigningKeyID {
+			return errors.Errorf("chain of custody violation: %q was signed by a different key than %q", r.Subject, r.Previous)
+		}
 	}
 
-	s.records = append(s.records, record{
-		subject:   *claims.Subject,
-		previous:  *claims.Previous,
-		operation: operation,
-		utcTime:   time.UTC().Unix(),
-	})
+	rec := record{
+		Subject:      r.Subject,
+		Previous:     r.Previous,
+		Operation:    r.Operation,
+		UTCTime:      r.UTCTime,
+		SigningKeyID: r.SigningKeyID,
+	}
+
+	if err := s.store.Append(rec); err != nil {
+		return err
+	}
+
+	s.cache.update(rec)
 	return nil
 }
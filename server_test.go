@@ -15,6 +15,9 @@
 package erfserver
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 	"testing"
 	"time"
 
@@ -78,7 +81,7 @@ var time2 = time1.Add(time.Second)
 var time3 = time2.Add(time.Second)
 
 func populateServer(t *testing.T) ERFServer {
-	server := NewInMemory()
+	server := NewInMemory(InsecureAllowNone{})
 
 	// 2 operations for [A]
 	server.Append(makeJWT(t, "", "A"), "op", time1)
@@ -137,6 +140,62 @@ func TestCountOperations(t *testing.T) {
 	}
 }
 
+func TestRebuildMatchesIncremental(t *testing.T) {
+	s := populateServer(t)
+
+	incrementalTotal := s.TotalClients()
+	incrementalRecent := s.RecentClients(time2)
+	incrementalOps := s.OperationsByClient()
+
+	require.NoError(t, s.(*server).Rebuild())
+
+	assert.Equal(t, incrementalTotal, s.TotalClients())
+	assert.Equal(t, incrementalRecent, s.RecentClients(time2))
+	assert.Equal(t, incrementalOps, s.OperationsByClient())
+}
+
+func TestReparentOutOfOrderMatchesRebuild(t *testing.T) {
+	s := NewInMemory(InsecureAllowNone{})
+
+	// B's rollover from A arrives before A's own rollover from X, so when X
+	// shows up it reparents an A that already has a child (B) which had
+	// already inherited A's old canonical ID. Both A and B must converge on
+	// X's ID, and the operation already counted against A's old ID must move
+	// with it, or this diverges from a Rebuild of the same records.
+	require.NoError(t, s.Append(makeJWT(t, "A", "B"), "op", time1))
+	require.NoError(t, s.Append(makeJWT(t, "X", "A"), "op", time1))
+
+	incrementalTotal := s.TotalClients()
+	incrementalOps := s.OperationsByClient()
+
+	require.NoError(t, s.(*server).Rebuild())
+
+	assert.Equal(t, incrementalTotal, s.TotalClients())
+	assert.Equal(t, incrementalOps, s.OperationsByClient())
+	assert.Equal(t, 2, incrementalOps["X"]["op"])
+}
+
+func TestChainOfCustodyViolationRejected(t *testing.T) {
+	keyA, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyB, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	v := NewStaticKeyVerifier(map[string]crypto.PublicKey{
+		"key-a": &keyA.PublicKey,
+		"key-b": &keyB.PublicKey,
+	})
+
+	server := NewInMemory(v)
+
+	require.NoError(t, server.Append(makeRSAJWT(t, keyA, "key-a", "", "A"), "op", time1))
+
+	err = server.Append(makeRSAJWT(t, keyB, "key-b", "A", "B"), "op", time1)
+	assert.Error(t, err)
+
+	assert.NoError(t, server.Append(makeRSAJWT(t, keyA, "key-a", "A", "B"), "op", time1))
+}
+
 func makeJWT(t *testing.T, prev, subj string) []byte {
 	claims := erf.ErfClaims{
 		Subject:    erf.StringPtr(subj),
@@ -0,0 +1,61 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package erfserver
+
+import (
+	"crypto"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	erf "github.com/thales-e-security/erfcommon"
+)
+
+// NewStaticKeyVerifier creates a TokenVerifier that checks tokens against a
+// fixed set of RSA or ECDSA public keys, selected by the token's "kid" header.
+func NewStaticKeyVerifier(keys map[string]crypto.PublicKey) TokenVerifier {
+	return &staticKeyVerifier{keys: keys}
+}
+
+type staticKeyVerifier struct {
+	keys map[string]crypto.PublicKey
+}
+
+// Verify implements TokenVerifier.Verify
+func (v *staticKeyVerifier) Verify(token []byte) (*erf.ErfClaims, string, error) {
+	var kid string
+
+	claims, err := parseWithKeyFunc(token, func(t *jwt.Token) (interface{}, error) {
+		if err := requireAsymmetricSigning(t); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if kid, err = kidFromToken(t); err != nil {
+			return nil, err
+		}
+
+		key, ok := v.keys[kid]
+		if !ok {
+			return nil, errors.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to verify token")
+	}
+
+	return claims, kid, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package erfserver
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	erf "github.com/thales-e-security/erfcommon"
+)
+
+func makeRSAJWT(t *testing.T, key *rsa.PrivateKey, kid, prev, subj string) []byte {
+	claims := erf.ErfClaims{
+		Subject:    erf.StringPtr(subj),
+		Previous:   erf.StringPtr(prev),
+		SequenceNo: erf.Int64Ptr(0),
+		IssuedAt:   erf.Int64Ptr(time.Now().Unix()),
+		ExpiresAt:  erf.Int64Ptr(time.Now().Add(20 * time.Second).Unix()),
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &claims)
+	token.Header["kid"] = kid
+
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return []byte(s)
+}
+
+func TestStaticKeyVerifierAcceptsValidSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	v := NewStaticKeyVerifier(map[string]crypto.PublicKey{"key1": &key.PublicKey})
+
+	claims, kid, err := v.Verify(makeRSAJWT(t, key, "key1", "", "A"))
+	require.NoError(t, err)
+	assert.Equal(t, "key1", kid)
+	assert.Equal(t, "A", *claims.Subject)
+}
+
+func TestStaticKeyVerifierRejectsUnknownKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	v := NewStaticKeyVerifier(map[string]crypto.PublicKey{"other-key": &key.PublicKey})
+
+	_, _, err = v.Verify(makeRSAJWT(t, key, "key1", "", "A"))
+	assert.Error(t, err)
+}
+
+func TestStaticKeyVerifierRejectsNoneAlgorithm(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	v := NewStaticKeyVerifier(map[string]crypto.PublicKey{"key1": &key.PublicKey})
+
+	_, _, err = v.Verify(makeJWT(t, "", "A"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,335 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package etcd provides an etcd v3 backed storage.RecordStore, so that
+// multiple erfserver instances can share ERF history behind a load balancer
+// instead of each keeping an independent in-memory log.
+package etcd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/thales-e-security/erfserver/storage"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// defaultPrefix namespaces every key written by a store, if Config.Prefix is unset.
+const defaultPrefix = "/erf/records/"
+
+// defaultRefreshInterval is used if Config.RefreshInterval is unset.
+const defaultRefreshInterval = 5 * time.Second
+
+// Config configures the etcd-backed RecordStore.
+type Config struct {
+	// Endpoints are the etcd cluster member addresses, e.g. "https://etcd-0:2379".
+	Endpoints []string
+
+	// Prefix namespaces every key written by this store. Defaults to "/erf/records/".
+	Prefix string
+
+	// DialTimeout bounds how long New waits to establish a connection. Defaults to 5s.
+	DialTimeout time.Duration
+
+	// Username and Password configure etcd's built-in auth. Leave both empty to disable auth.
+	Username string
+	Password string
+
+	// TLS configures a client certificate and CA bundle for talking to etcd over TLS.
+	// Leave nil to connect without TLS.
+	TLS *TLSConfig
+
+	// RefreshInterval is how often erfserver should rebuild its DAG cache
+	// from this store, to pick up records written by other erfserver
+	// instances sharing this etcd cluster. Defaults to 5s.
+	RefreshInterval time.Duration
+}
+
+// TLSConfig identifies the files used to secure the etcd client connection.
+type TLSConfig struct {
+	// CAFile is a PEM encoded bundle used to verify the etcd server certificate.
+	CAFile string
+
+	// CertFile and KeyFile are a PEM encoded client certificate and key, used for mutual TLS.
+	CertFile string
+	KeyFile  string
+}
+
+// New connects to the etcd cluster described by cfg and returns a
+// storage.RecordStore backed by it. The returned store keeps an in-process
+// cache of every record, populated by an initial range read and kept warm by
+// a watch on Prefix, so that reads made through the store don't have to
+// re-fetch the whole key range on every call. It also implements
+// storage.Shared, so an erfserver built on top of it periodically rebuilds
+// its DAG cache from this store, and so picks up clients created by other
+// erfserver instances sharing the same etcd cluster behind a load balancer.
+func New(cfg Config) (storage.RecordStore, error) {
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+
+	dialTimeout := cfg.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 5 * time.Second
+	}
+
+	refreshInterval := cfg.RefreshInterval
+	if refreshInterval == 0 {
+		refreshInterval = defaultRefreshInterval
+	}
+
+	tlsConfig, err := buildTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure etcd TLS")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: dialTimeout,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to etcd")
+	}
+
+	instanceID, err := randomInstanceID()
+	if err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "failed to generate store instance ID")
+	}
+
+	s := &store{
+		client:          client,
+		prefix:          prefix,
+		refreshInterval: refreshInterval,
+		instanceID:      instanceID,
+	}
+
+	rev, err := s.warmCache()
+	if err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "failed to warm etcd record cache")
+	}
+
+	go s.watch(rev + 1)
+
+	return s, nil
+}
+
+func buildTLSConfig(cfg *TLSConfig) (*tls.Config, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	var tlsConfig tls.Config
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CAFile != "" {
+		caData, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read CA bundle")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("no certificates found in CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &tlsConfig, nil
+}
+
+// store is an etcd v3 backed storage.RecordStore. Every record is written
+// under prefix+<utcTime>-<instanceID>-<seq>-<subject>, zero-padded so that a
+// lexical range read is also a chronological range read. Reads are served
+// from the in-process cache, not from etcd: Iterate filters that cache by
+// since and does not issue a range read from a since key.
+type store struct {
+	client *clientv3.Client
+	prefix string
+
+	// refreshInterval is returned by RefreshInterval, so that erfserver
+	// periodically rebuilds its DAG cache from this store and picks up
+	// records appended by other instances sharing it.
+	refreshInterval time.Duration
+
+	// mux protects cache, which holds every record seen so far so that reads
+	// don't have to re-fetch the whole key range on every RPC.
+	mux   sync.RWMutex
+	cache []storage.Record
+
+	// seq is a process-local counter appended to every key so that two
+	// records for the same subject written within the same UTCTime second
+	// don't collide and silently overwrite one another. It is combined with
+	// instanceID so that concurrent erfserver instances sharing this etcd
+	// cluster don't collide with each other either.
+	seq        uint64
+	instanceID uint32
+}
+
+// RefreshInterval implements storage.Shared.RefreshInterval.
+func (s *store) RefreshInterval() time.Duration {
+	return s.refreshInterval
+}
+
+// Append implements storage.RecordStore.Append
+func (s *store) Append(r storage.Record) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal record")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	seq := atomic.AddUint64(&s.seq, 1)
+	if _, err := s.client.Put(ctx, s.recordKey(r, seq), string(value)); err != nil {
+		return errors.Wrap(err, "failed to write record to etcd")
+	}
+
+	// The watch started by New will also observe this write and append it to
+	// the cache; appending here too would double it up, so leave that to the
+	// watch and simply let the caller know the write succeeded.
+	return nil
+}
+
+// Iterate implements storage.RecordStore.Iterate
+func (s *store) Iterate(since *time.Time, fn func(storage.Record) bool) error {
+	records, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	var sinceUTC int64
+	if since != nil {
+		sinceUTC = since.UTC().Unix()
+	}
+
+	for _, r := range records {
+		if since != nil && r.UTCTime < sinceUTC {
+			continue
+		}
+		if !fn(r) {
+			break
+		}
+	}
+	return nil
+}
+
+// Snapshot implements storage.RecordStore.Snapshot. It is served from the
+// in-process cache rather than etcd, so it is cheap to call on every RPC.
+func (s *store) Snapshot() ([]storage.Record, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	res := make([]storage.Record, len(s.cache))
+	copy(res, s.cache)
+	return res, nil
+}
+
+// warmCache performs the initial range read of prefix to populate the cache
+// before the watch takes over, and returns the revision the server serviced
+// that read at, so the caller can start watching from the next revision
+// without missing or double-applying a write.
+func (s *store) warmCache() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return 0, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, kv := range resp.Kvs {
+		var r storage.Record
+		if err := json.Unmarshal(kv.Value, &r); err != nil {
+			return 0, errors.Wrapf(err, "failed to decode record at key %q", kv.Key)
+		}
+		s.cache = append(s.cache, r)
+	}
+
+	return resp.Header.Revision, nil
+}
+
+// watch keeps the cache warm by following every write under prefix from rev
+// onwards, so that it picks up exactly where warmCache left off with no gap
+// and no overlap. It runs for the lifetime of the store.
+func (s *store) watch(rev int64) {
+	watchChan := s.client.Watch(context.Background(), s.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev))
+
+	for resp := range watchChan {
+		for _, ev := range resp.Events {
+			if ev.Type != clientv3.EventTypePut {
+				continue
+			}
+
+			var r storage.Record
+			if err := json.Unmarshal(ev.Kv.Value, &r); err != nil {
+				// A record we can't decode shouldn't take down the whole
+				// watch; skip it and keep serving the records we do understand.
+				continue
+			}
+
+			s.mux.Lock()
+			s.cache = append(s.cache, r)
+			s.mux.Unlock()
+		}
+	}
+}
+
+// recordKey returns the etcd key a record is stored under, zero-padded so
+// that byte-lexical ordering of keys matches chronological ordering of
+// records. seq (and instanceID, to distinguish concurrent store instances)
+// make the key unique even when two records for the same subject share a
+// UTCTime, which would otherwise collide and the second Put would silently
+// overwrite the first.
+func (s *store) recordKey(r storage.Record, seq uint64) string {
+	return fmt.Sprintf("%s%020d-%08x-%020d-%s", s.prefix, r.UTCTime, s.instanceID, seq, r.Subject)
+}
+
+// randomInstanceID returns a random, process-lifetime identifier used to
+// namespace this store's sequence numbers from those of any other erfserver
+// instance sharing the same etcd cluster.
+func randomInstanceID() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package etcd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thales-e-security/erfserver/storage"
+)
+
+func TestRecordKeyOrderingMatchesChronologicalOrder(t *testing.T) {
+	s := &store{prefix: defaultPrefix}
+
+	records := []storage.Record{
+		{Subject: "C", UTCTime: 300},
+		{Subject: "A", UTCTime: 100},
+		{Subject: "B", UTCTime: 200},
+	}
+
+	keys := make([]string, len(records))
+	for i, r := range records {
+		keys[i] = s.recordKey(r, uint64(i))
+	}
+
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+
+	assert.Equal(t, []string{keys[1], keys[2], keys[0]}, sorted)
+}
+
+func TestRecordKeyDiscriminatesRecordsWithTheSameSubjectAndUTCTime(t *testing.T) {
+	s := &store{prefix: defaultPrefix}
+	r := storage.Record{Subject: "A", UTCTime: 100}
+
+	first := s.recordKey(r, 1)
+	second := s.recordKey(r, 2)
+
+	assert.NotEqual(t, first, second)
+}
+
+func TestBuildTLSConfigNilLeavesTLSDisabled(t *testing.T) {
+	tlsConfig, err := buildTLSConfig(nil)
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+}
+
+func TestBuildTLSConfigLoadsCABundle(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeSelfSignedCert(t, caFile)
+
+	tlsConfig, err := buildTLSConfig(&TLSConfig{CAFile: caFile})
+	require.NoError(t, err)
+	require.NotNil(t, tlsConfig)
+	assert.NotNil(t, tlsConfig.RootCAs)
+}
+
+func TestBuildTLSConfigRejectsEmptyCABundle(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "empty.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, []byte("not a certificate"), 0600))
+
+	_, err := buildTLSConfig(&TLSConfig{CAFile: caFile})
+	assert.Error(t, err)
+}
+
+func TestDefaultRefreshIntervalIsFiveSeconds(t *testing.T) {
+	s := &store{refreshInterval: defaultRefreshInterval}
+	assert.Equal(t, 5*time.Second, s.RefreshInterval())
+}
+
+// writeSelfSignedCert writes a throwaway self-signed certificate to path,
+// suitable for exercising buildTLSConfig's CA-bundle loading path.
+func writeSelfSignedCert(t *testing.T, path string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "erfserver-test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	require.NoError(t, ioutil.WriteFile(path, pemBytes, 0600))
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// NewMemory creates a RecordStore that keeps records in a plain in-memory
+// slice. All state is lost on restart.
+func NewMemory() RecordStore {
+	return &memoryStore{}
+}
+
+type memoryStore struct {
+	// mux protects records
+	mux sync.Mutex
+
+	records []Record
+}
+
+// Append implements RecordStore.Append
+func (s *memoryStore) Append(r Record) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.records = append(s.records, r)
+	return nil
+}
+
+// Iterate implements RecordStore.Iterate
+func (s *memoryStore) Iterate(since *time.Time, fn func(Record) bool) error {
+	records, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	var sinceUTC int64
+	if since != nil {
+		sinceUTC = since.UTC().Unix()
+	}
+
+	for _, r := range records {
+		if since != nil && r.UTCTime < sinceUTC {
+			continue
+		}
+		if !fn(r) {
+			break
+		}
+	}
+	return nil
+}
+
+// Snapshot implements RecordStore.Snapshot
+func (s *memoryStore) Snapshot() ([]Record, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	res := make([]Record, len(s.records))
+	copy(res, s.records)
+	return res, nil
+}
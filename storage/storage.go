@@ -0,0 +1,72 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package storage defines the persistence layer used by erfserver to hold the
+// append-only log of ERF operation records. erfserver talks to a RecordStore
+// rather than an in-memory slice directly, so the server can run against a
+// throwaway in-process store (see NewMemory) or a durable, shared store such
+// as the etcd subpackage without any change to the RPC layer.
+package storage
+
+import "time"
+
+// Record captures the data for a single operation. It is the unit of
+// persistence used by every RecordStore implementation.
+type Record struct {
+	// Subject is the ERF at the time of the operation.
+	Subject string
+
+	// Previous is the previous ERF (or "" if the ERF hasn't rolled over yet).
+	Previous string
+
+	// Operation is a string description of the operation the client performed.
+	Operation string
+
+	// UTCTime is the time the operation was received by the server, as UTC Unix seconds.
+	UTCTime int64
+
+	// SigningKeyID identifies the key that signed the token this record was derived from,
+	// so that a chain-of-custody check can confirm a later record for the same ERF chain
+	// was signed by the same key.
+	SigningKeyID string
+}
+
+// RecordStore persists the append-only log of Records backing an ERFServer.
+// Implementations must be safe for concurrent use.
+type RecordStore interface {
+	// Append persists a single record. Implementations must return records
+	// from Iterate and Snapshot in the order they were appended.
+	Append(r Record) error
+
+	// Iterate calls fn once for every stored record with UTCTime >= since (or
+	// every record, if since is nil), in append order. Iteration stops early,
+	// without error, the first time fn returns false.
+	Iterate(since *time.Time, fn func(Record) bool) error
+
+	// Snapshot returns a copy of every record currently persisted.
+	Snapshot() ([]Record, error)
+}
+
+// Shared is implemented by RecordStore backends whose records may be written
+// by other processes as well as this one, such as the etcd subpackage, where
+// several erfserver instances share one etcd cluster behind a load balancer.
+// erfserver uses this, when a store implements it, to periodically rebuild
+// its cache from Snapshot so that records appended by those other processes
+// are picked up even though this instance's own Append never sees them.
+type Shared interface {
+	// RefreshInterval is how often the cache should be rebuilt from
+	// Snapshot. A value <= 0 disables the periodic rebuild.
+	RefreshInterval() time.Duration
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Thales UK Limited
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and associated
+// documentation files (the "Software"), to deal in the Software without restriction, including without limitation the
+// rights to use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all copies or substantial portions of the
+// Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE
+// WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR
+// OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package erfserver
+
+import (
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	erf "github.com/thales-e-security/erfcommon"
+)
+
+// TokenVerifier authenticates an ERF token and reports the ID of the key that
+// signed it, so Append can confirm a record's signer matches the signer of
+// the record it claims to follow.
+type TokenVerifier interface {
+	// Verify parses and validates token, returning its claims and the ID of
+	// the key that signed it.
+	Verify(token []byte) (*erf.ErfClaims, string, error)
+}
+
+// requireAsymmetricSigning rejects any signing method other than RSA or
+// ECDSA, most importantly SigningMethodNone, which erf.ParseToken accepted
+// unconditionally.
+func requireAsymmetricSigning(token *jwt.Token) error {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		return nil
+	default:
+		return errors.Errorf("unsupported signing method %q", token.Header["alg"])
+	}
+}
+
+// kidFromToken extracts the "kid" header used to select a verification key.
+func kidFromToken(token *jwt.Token) (string, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		return "", errors.New(`token is missing a "kid" header`)
+	}
+	return kid, nil
+}
+
+// parseWithKeyFunc parses token with jwt-go, resolving the verification key
+// through keyFunc, and additionally rejects tokens that have expired.
+func parseWithKeyFunc(token []byte, keyFunc jwt.Keyfunc) (*erf.ErfClaims, error) {
+	var claims erf.ErfClaims
+
+	if _, err := jwt.ParseWithClaims(string(token), &claims, keyFunc); err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt != nil && time.Now().Unix() > *claims.ExpiresAt {
+		return nil, errors.New("token has expired")
+	}
+
+	return &claims, nil
+}
@@ -70,3 +70,13 @@ func (s *stringSet) values() []string {
 	copy(res, s.keys)
 	return res
 }
+
+// contains reports whether val has already been added to the set.
+func (s *stringSet) contains(val string) bool {
+	return s.set[val]
+}
+
+// size returns the number of unique strings in the set.
+func (s *stringSet) size() int {
+	return len(s.keys)
+}